@@ -0,0 +1,89 @@
+package libkbfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// BlockServerDriver is a backend for storing and retrieving raw block
+// data. It is the unit that BlockServerMux composes to let a single
+// BlockServer mix multiple storage backends (for example, a local SSD
+// cache in front of S3 cold storage).
+type BlockServerDriver interface {
+	// Name returns the name this driver was registered under.
+	Name() string
+	// Get returns the raw data for bid, or an error if it is absent.
+	Get(ctx context.Context, bid BlockID) ([]byte, error)
+	// Put stores buf as the raw data for bid.
+	Put(ctx context.Context, bid BlockID, buf []byte) error
+	// Delete removes bid. It is not an error to delete a missing block.
+	Delete(ctx context.Context, bid BlockID) error
+	// Status returns a short driver-specific status string, suitable
+	// for inclusion in health checks.
+	Status(ctx context.Context) (string, error)
+}
+
+// BlockServerDriverFactory builds a BlockServerDriver from its
+// driver-specific configuration. params comes from BlockBackendConfig's
+// Params field, either passed through directly (when building a
+// BlockServerMux in Go code) or decoded from JSON/TOML by LoadInitConfig
+// (in which case it's a map[string]interface{}); use decodeParams to
+// turn it into the factory's own params type either way.
+type BlockServerDriverFactory func(config Config, params interface{}) (BlockServerDriver, error)
+
+// decodeParams converts params, which may already be out (or a pointer
+// to the same type out points to) or may be the map[string]interface{}
+// that JSON/TOML decoding into a BlockBackendConfig.Params field always
+// produces, into out. It round-trips through encoding/json so that it
+// works regardless of which case params is in.
+func decodeParams(params interface{}, out interface{}) error {
+	buf, err := json.Marshal(params)
+	if err != nil {
+		return fmt.Errorf("cannot re-marshal block backend params: %v", err)
+	}
+	if err := json.Unmarshal(buf, out); err != nil {
+		return fmt.Errorf("cannot decode block backend params into %T: %v", out, err)
+	}
+	return nil
+}
+
+var (
+	blockServerDriversMu sync.Mutex
+	blockServerDrivers   = map[string]BlockServerDriverFactory{}
+)
+
+// RegisterBlockServerDriver makes a block server driver available
+// under name, for use in a BlockBackendConfig.Driver field. It is
+// meant to be called from the init() function of a package that
+// implements a BlockServerDriver.
+func RegisterBlockServerDriver(name string, factory BlockServerDriverFactory) {
+	blockServerDriversMu.Lock()
+	defer blockServerDriversMu.Unlock()
+	blockServerDrivers[name] = factory
+}
+
+func newBlockServerDriver(config Config, name string, params interface{}) (BlockServerDriver, error) {
+	blockServerDriversMu.Lock()
+	factory, ok := blockServerDrivers[name]
+	blockServerDriversMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no block server driver registered under %q", name)
+	}
+	return factory(config, params)
+}
+
+// BlockBackendConfig names a BlockServerDriver, its params, and whether
+// it is written to, for use in the blockBackends list passed to Init.
+type BlockBackendConfig struct {
+	// Driver is the name a BlockServerDriver was registered under,
+	// e.g. "fs", "s3", or "mem".
+	Driver string
+	// Params is passed as-is to that driver's BlockServerDriverFactory.
+	Params interface{}
+	// Writable is false for backends that should only ever be read
+	// from (e.g. a shared read-only mirror).
+	Writable bool
+}
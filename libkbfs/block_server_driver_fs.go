@@ -0,0 +1,54 @@
+package libkbfs
+
+import (
+	"golang.org/x/net/context"
+)
+
+func init() {
+	RegisterBlockServerDriver("fs", newFSBlockServerDriver)
+}
+
+// FSBlockServerDriverParams configures an fsBlockServerDriver.
+type FSBlockServerDriverParams struct {
+	// Dir is the directory BlockServerLocal should use to store
+	// blocks, i.e. the same path previously passed directly to
+	// NewBlockServerLocal.
+	Dir string
+}
+
+// fsBlockServerDriver is a BlockServerDriver that wraps the existing
+// BlockServerLocal on-disk layout, so that the "fs" driver behaves
+// exactly like the BlockServer Init previously constructed directly.
+type fsBlockServerDriver struct {
+	bserv *BlockServerLocal
+}
+
+func newFSBlockServerDriver(config Config, params interface{}) (BlockServerDriver, error) {
+	var p FSBlockServerDriverParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	bserv, err := NewBlockServerLocal(config, p.Dir)
+	if err != nil {
+		return nil, err
+	}
+	return &fsBlockServerDriver{bserv: bserv}, nil
+}
+
+func (d *fsBlockServerDriver) Name() string { return "fs" }
+
+func (d *fsBlockServerDriver) Get(ctx context.Context, bid BlockID) ([]byte, error) {
+	return d.bserv.GetRaw(ctx, bid)
+}
+
+func (d *fsBlockServerDriver) Put(ctx context.Context, bid BlockID, buf []byte) error {
+	return d.bserv.PutRaw(ctx, bid, buf)
+}
+
+func (d *fsBlockServerDriver) Delete(ctx context.Context, bid BlockID) error {
+	return d.bserv.DeleteRaw(ctx, bid)
+}
+
+func (d *fsBlockServerDriver) Status(ctx context.Context) (string, error) {
+	return "ok", nil
+}
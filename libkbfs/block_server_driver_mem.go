@@ -0,0 +1,56 @@
+package libkbfs
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+func init() {
+	RegisterBlockServerDriver("mem", newMemBlockServerDriver)
+}
+
+// memBlockServerDriver is a BlockServerDriver that keeps everything in
+// an in-memory map. It's mainly useful as a cheap writable replica in
+// tests, or layered in front of a slower backend as a cache.
+type memBlockServerDriver struct {
+	lock   sync.RWMutex
+	blocks map[BlockID][]byte
+}
+
+func newMemBlockServerDriver(config Config, params interface{}) (BlockServerDriver, error) {
+	return &memBlockServerDriver{blocks: make(map[BlockID][]byte)}, nil
+}
+
+func (d *memBlockServerDriver) Name() string { return "mem" }
+
+func (d *memBlockServerDriver) Get(ctx context.Context, bid BlockID) ([]byte, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	buf, ok := d.blocks[bid]
+	if !ok {
+		return nil, BServerErrorBlockNonExistent{}
+	}
+	return buf, nil
+}
+
+func (d *memBlockServerDriver) Put(ctx context.Context, bid BlockID, buf []byte) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.blocks[bid] = buf
+	return nil
+}
+
+func (d *memBlockServerDriver) Delete(ctx context.Context, bid BlockID) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.blocks, bid)
+	return nil
+}
+
+func (d *memBlockServerDriver) Status(ctx context.Context) (string, error) {
+	d.lock.RLock()
+	defer d.lock.RUnlock()
+	return fmt.Sprintf("%d blocks", len(d.blocks)), nil
+}
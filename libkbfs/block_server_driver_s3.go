@@ -0,0 +1,92 @@
+package libkbfs
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"golang.org/x/net/context"
+)
+
+func init() {
+	RegisterBlockServerDriver("s3", newS3BlockServerDriver)
+}
+
+// S3BlockServerDriverParams configures an s3BlockServerDriver.
+type S3BlockServerDriverParams struct {
+	// Bucket is the S3 bucket holding block data.
+	Bucket string
+	// Prefix is prepended to every block ID to form its S3 key, e.g.
+	// "kbfs/blocks/".
+	Prefix string
+	// Region is the AWS region the bucket lives in.
+	Region string
+}
+
+// s3BlockServerDriver is a BlockServerDriver backed by an S3 (or
+// S3-compatible) bucket, for use as cold storage behind a faster local
+// driver in a BlockServerMux.
+type s3BlockServerDriver struct {
+	params S3BlockServerDriverParams
+	s3     *s3.S3
+}
+
+func newS3BlockServerDriver(config Config, params interface{}) (BlockServerDriver, error) {
+	var p S3BlockServerDriverParams
+	if err := decodeParams(params, &p); err != nil {
+		return nil, err
+	}
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(p.Region)})
+	if err != nil {
+		return nil, err
+	}
+	return &s3BlockServerDriver{params: p, s3: s3.New(sess)}, nil
+}
+
+func (d *s3BlockServerDriver) Name() string { return "s3" }
+
+func (d *s3BlockServerDriver) key(bid BlockID) string {
+	return path.Join(d.params.Prefix, bid.String())
+}
+
+func (d *s3BlockServerDriver) Get(ctx context.Context, bid BlockID) ([]byte, error) {
+	out, err := d.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(d.params.Bucket),
+		Key:    aws.String(d.key(bid)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	return ioutil.ReadAll(out.Body)
+}
+
+func (d *s3BlockServerDriver) Put(ctx context.Context, bid BlockID, buf []byte) error {
+	_, err := d.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(d.params.Bucket),
+		Key:    aws.String(d.key(bid)),
+		Body:   bytes.NewReader(buf),
+	})
+	return err
+}
+
+func (d *s3BlockServerDriver) Delete(ctx context.Context, bid BlockID) error {
+	_, err := d.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(d.params.Bucket),
+		Key:    aws.String(d.key(bid)),
+	})
+	return err
+}
+
+func (d *s3BlockServerDriver) Status(ctx context.Context) (string, error) {
+	_, err := d.s3.HeadBucketWithContext(ctx, &s3.HeadBucketInput{
+		Bucket: aws.String(d.params.Bucket),
+	})
+	if err != nil {
+		return "", err
+	}
+	return "ok", nil
+}
@@ -0,0 +1,176 @@
+package libkbfs
+
+import (
+	"fmt"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/context"
+)
+
+var (
+	blockOpsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "kbfs",
+		Subsystem: "block",
+		Name:      "ops_total",
+		Help:      "Count of block server driver operations, by driver, op, and status.",
+	}, []string{"driver", "op", "status"})
+
+	blockOpSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "kbfs",
+		Subsystem: "block",
+		Name:      "op_seconds",
+		Help:      "Latency of block server driver operations, by driver and op.",
+	}, []string{"driver", "op"})
+)
+
+func init() {
+	prometheus.MustRegister(blockOpsTotal)
+	prometheus.MustRegister(blockOpSeconds)
+}
+
+// instrumentedDriver wraps a BlockServerDriver so that every call is
+// recorded in the kbfs_block_ops_total counter and
+// kbfs_block_op_seconds histogram.
+type instrumentedDriver struct {
+	BlockServerDriver
+}
+
+func instrument(driver BlockServerDriver) BlockServerDriver {
+	return &instrumentedDriver{BlockServerDriver: driver}
+}
+
+func (d *instrumentedDriver) observe(op string, f func() error) error {
+	timer := prometheus.NewTimer(blockOpSeconds.WithLabelValues(d.Name(), op))
+	err := f()
+	timer.ObserveDuration()
+	status := "ok"
+	if err != nil {
+		status = "error"
+	}
+	blockOpsTotal.WithLabelValues(d.Name(), op, status).Inc()
+	return err
+}
+
+func (d *instrumentedDriver) Get(ctx context.Context, bid BlockID) (buf []byte, err error) {
+	err = d.observe("get", func() error {
+		var innerErr error
+		buf, innerErr = d.BlockServerDriver.Get(ctx, bid)
+		return innerErr
+	})
+	return buf, err
+}
+
+func (d *instrumentedDriver) Put(ctx context.Context, bid BlockID, buf []byte) error {
+	return d.observe("put", func() error {
+		return d.BlockServerDriver.Put(ctx, bid, buf)
+	})
+}
+
+func (d *instrumentedDriver) Delete(ctx context.Context, bid BlockID) error {
+	return d.observe("delete", func() error {
+		return d.BlockServerDriver.Delete(ctx, bid)
+	})
+}
+
+func (d *instrumentedDriver) Status(ctx context.Context) (status string, err error) {
+	err = d.observe("status", func() error {
+		var innerErr error
+		status, innerErr = d.BlockServerDriver.Status(ctx)
+		return innerErr
+	})
+	return status, err
+}
+
+// muxDriver pairs a BlockServerDriver with whether it should be
+// written to.
+type muxDriver struct {
+	driver   BlockServerDriver
+	writable bool
+}
+
+// BlockServerMux is a BlockServer that reads from the first of a list
+// of BlockServerDrivers that has the requested block, and writes to
+// all writable drivers, up to replicaCount of them, so that a
+// deployment can mix e.g. a local SSD cache with S3 cold storage
+// without forking libkbfs.
+type BlockServerMux struct {
+	config       Config
+	drivers      []muxDriver
+	replicaCount int
+}
+
+// NewBlockServerMux composes backends, in priority order, into a
+// single BlockServer. replicaCount caps how many writable drivers a
+// Put is written to; 0 means "all of them".
+func NewBlockServerMux(config Config, backends []BlockBackendConfig, replicaCount int) (*BlockServerMux, error) {
+	mux := &BlockServerMux{config: config, replicaCount: replicaCount}
+	for _, backend := range backends {
+		driver, err := newBlockServerDriver(config, backend.Driver, backend.Params)
+		if err != nil {
+			return nil, err
+		}
+		mux.drivers = append(mux.drivers, muxDriver{
+			driver:   instrument(driver),
+			writable: backend.Writable,
+		})
+	}
+	return mux, nil
+}
+
+// GetRaw returns the raw block data for bid from the first driver that
+// has it.
+func (m *BlockServerMux) GetRaw(ctx context.Context, bid BlockID) ([]byte, error) {
+	var lastErr error
+	for _, d := range m.drivers {
+		buf, err := d.driver.Get(ctx, bid)
+		if err == nil {
+			return buf, nil
+		}
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("no block server drivers configured")
+	}
+	return nil, lastErr
+}
+
+// PutRaw writes buf as the data for bid to up to replicaCount writable
+// drivers.
+func (m *BlockServerMux) PutRaw(ctx context.Context, bid BlockID, buf []byte) error {
+	written := 0
+	var lastErr error
+	for _, d := range m.drivers {
+		if !d.writable {
+			continue
+		}
+		if m.replicaCount > 0 && written >= m.replicaCount {
+			break
+		}
+		if err := d.driver.Put(ctx, bid, buf); err != nil {
+			lastErr = err
+			continue
+		}
+		written++
+	}
+	if written == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no writable block server drivers configured")
+		}
+		return lastErr
+	}
+	return nil
+}
+
+// DeleteRaw removes bid from every writable driver.
+func (m *BlockServerMux) DeleteRaw(ctx context.Context, bid BlockID) error {
+	var lastErr error
+	for _, d := range m.drivers {
+		if !d.writable {
+			continue
+		}
+		if err := d.driver.Delete(ctx, bid); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
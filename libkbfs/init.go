@@ -1,77 +1,158 @@
 package libkbfs
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"runtime/pprof"
+	"sync"
+	"syscall"
 
 	"github.com/keybase/client/go/client"
 	"github.com/keybase/client/go/libkb"
-	"github.com/keybase/client/protocol/go"
+	"github.com/keybase/client/go/libkbfs/keyring"
+	"github.com/keybase/client/go/libkbfs/kv"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 )
 
-func getMDServerAddr() string {
+// envLogLevel is the environment variable libkb.G.ConfigureLogging reads
+// to pick its minimum log level; Init sets it from InitConfig.LogLevel
+// before calling ConfigureLogging so that the config file can control
+// it the same way EnvMDServerAddr controls the MD server address.
+const envLogLevel = "KEYBASE_LOG_LEVEL"
+
+// levelDBName is the directory, relative to serverRootDir, where the
+// shared LevelDB database for the local MD, key, and block servers
+// lives.
+const levelDBName = "kbfs_leveldb"
+
+// openLevelDB opens the shared LevelDB database rooted at
+// serverRootDir, if any. It returns a nil db (and nil error) when
+// serverRootDir is nil, in which case callers should fall back to the
+// in-memory or per-file local servers.
+func openLevelDB(serverRootDir *string) (kv.DB, error) {
+	if serverRootDir == nil {
+		return nil, nil
+	}
+	return kv.OpenLevelDB(filepath.Join(*serverRootDir, levelDBName))
+}
+
+// getMDServerAddr returns the address of the remote MD server to use,
+// preferring mdServerAddr (normally InitConfig.MDServerAddr) when it is
+// set, and falling back to the environment variable previously used to
+// configure it.
+func getMDServerAddr(mdServerAddr string) string {
+	if mdServerAddr != "" {
+		return mdServerAddr
+	}
 	// XXX TODO: the source of this will likely change soon
 	return os.Getenv(EnvMDServerAddr)
 }
 
-func useLocalMDServer() bool {
-	return len(getMDServerAddr()) == 0
+func useLocalMDServer(mdServerAddr string) bool {
+	return len(getMDServerAddr(mdServerAddr)) == 0
 }
 
-func useLocalKeyServer() bool {
+func useLocalKeyServer(mdServerAddr string) bool {
 	// currently the remote MD server also acts as the key server.
-	return useLocalMDServer()
+	return useLocalMDServer(mdServerAddr)
 }
 
-func makeMDServer(config Config, serverRootDir *string) (
-	MDServer, error) {
+func makeMDServer(config Config, serverRootDir *string, db kv.DB, mdPeers []string,
+	mdPeerMe int, mdServerAddr, mdServerTLSCertPath string) (MDServer, error) {
 	var err error
 	var mdServer MDServer
-	if useLocalMDServer() {
+	if useLocalMDServer(mdServerAddr) {
+		if len(mdPeers) > 0 {
+			if serverRootDir == nil {
+				return nil, fmt.Errorf("--md-peers requires a server root directory")
+			}
+			// Paxos-replicated local MD server, for a small
+			// self-hosted cluster or multi-node integration test.
+			return NewMDServerPaxos(config, db, mdPeers, mdPeerMe, *serverRootDir)
+		}
 		if serverRootDir == nil {
 			// local in-memory MD server
 			mdServer, err = NewMDServerMemory(config)
 			if err != nil {
 				return nil, err
 			}
-		}
-		// local persistent MD server
-		handlePath := filepath.Join(*serverRootDir, "kbfs_handles")
-		mdPath := filepath.Join(*serverRootDir, "kbfs_md")
-		revPath := filepath.Join(*serverRootDir, "kbfs_revisions")
-		mdServer, err = NewMDServerLocal(
-			config, handlePath, mdPath, revPath)
-		if err != nil {
-			return nil, err
+		} else if db != nil {
+			// local persistent MD server, backed by the shared LevelDB
+			mdServer, err = NewMDServerLevelDB(config, db)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			// local persistent MD server, one flat file per table
+			handlePath := filepath.Join(*serverRootDir, "kbfs_handles")
+			mdPath := filepath.Join(*serverRootDir, "kbfs_md")
+			revPath := filepath.Join(*serverRootDir, "kbfs_revisions")
+			mdServer, err = NewMDServerLocal(
+				config, handlePath, mdPath, revPath)
+			if err != nil {
+				return nil, err
+			}
 		}
 	} else {
+		var tlsConfig *tls.Config
+		if mdServerTLSCertPath != "" {
+			tlsConfig, err = loadClientTLSConfig(mdServerTLSCertPath)
+			if err != nil {
+				return nil, fmt.Errorf("cannot load MD server TLS cert %s: %v", mdServerTLSCertPath, err)
+			}
+		}
 		// this can't fail. reconnection attempts will be automatic.
-		mdServer = NewMDServerRemote(context.TODO(), config, getMDServerAddr())
+		mdServer = NewMDServerRemote(context.TODO(), config, getMDServerAddr(mdServerAddr), tlsConfig)
 	}
 	return mdServer, nil
 }
 
-func makeKeyServer(config Config, serverRootDir *string) (
+// loadClientTLSConfig builds a *tls.Config that trusts the PEM-encoded
+// certificate at certPath, for validating a remote MD server's TLS
+// connection.
+func loadClientTLSConfig(certPath string) (*tls.Config, error) {
+	pem, err := ioutil.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", certPath)
+	}
+	return &tls.Config{RootCAs: pool}, nil
+}
+
+func makeKeyServer(config Config, serverRootDir *string, db kv.DB, mdServerAddr string) (
 	KeyServer, error) {
 	var err error
 	var keyServer KeyServer
-	if useLocalKeyServer() {
+	if useLocalKeyServer(mdServerAddr) {
 		if serverRootDir == nil {
 			// local in-memory key server
 			keyServer, err = NewKeyServerMemory(config)
 			if err != nil {
 				return nil, err
 			}
-		}
-		// local persistent key server
-		keyPath := filepath.Join(*serverRootDir, "kbfs_key")
-		keyServer, err = NewKeyServerLocal(config, keyPath)
-		if err != nil {
-			return nil, err
+		} else if db != nil {
+			// local persistent key server, backed by the shared LevelDB
+			keyServer, err = NewKeyServerLevelDB(config, db)
+			if err != nil {
+				return nil, err
+			}
+		} else {
+			// local persistent key server
+			keyPath := filepath.Join(*serverRootDir, "kbfs_key")
+			keyServer, err = NewKeyServerLocal(config, keyPath)
+			if err != nil {
+				return nil, err
+			}
 		}
 	} else {
 		// currently the remote MD server also acts as the key server.
@@ -80,36 +161,62 @@ func makeKeyServer(config Config, serverRootDir *string) (
 	return keyServer, nil
 }
 
-func makeBlockServer(config Config, serverRootDir *string) (BlockServer, error) {
+func makeBlockServer(config Config, serverRootDir *string, db kv.DB,
+	blockBackends []BlockBackendConfig, blockReplicaCount int) (BlockServer, error) {
+	if len(blockBackends) > 0 {
+		return NewBlockServerMux(config, blockBackends, blockReplicaCount)
+	}
+
 	if serverRootDir == nil {
 		return NewBlockServerMemory(config)
 	}
 
+	if db != nil {
+		return NewBlockServerLevelDB(config, db)
+	}
+
 	blockPath := filepath.Join(*serverRootDir, "kbfs_block")
 	return NewBlockServerLocal(config, blockPath)
 }
 
-// Init initializes a config and returns it. If localUser is
-// non-empty, libkbfs does not communicate to any remote servers and
-// instead uses fake implementations of various servers.
-//
-// If serverRootDir is nil, an in-memory server is used. If it is
-// non-nil and points to the empty string, the current working
-// directory is used. Otherwise, the pointed-to string is treated as a
-// path.
-//
-// onInterruptFn is called whenever an interrupt signal is received
-// (e.g., if the user hits Ctrl-C).
-//
-// Init should be called at the beginning of main. Shutdown (see
-// below) should then be called at the end of main (usually via
-// defer).
-func Init(localUser string, serverRootDir *string, cpuProfilePath, memProfilePath string, onInterruptFn func()) (Config, error) {
+// startMetricsServer serves Prometheus metrics, including the
+// kbfs_block_ops_total and kbfs_block_op_seconds series recorded by
+// BlockServerMux, on addr at /metrics. It returns immediately; errors
+// from the listener are logged rather than returned, since a failure
+// to export metrics shouldn't prevent libkbfs from starting.
+func startMetricsServer(addr string) {
+	if addr == "" {
+		return
+	}
+	http.Handle("/metrics", prometheus.Handler())
+	go func() {
+		if err := http.ListenAndServe(addr, nil); err != nil {
+			libkb.G.Log.Warning("metrics server on %s exited: %v", addr, err)
+		}
+	}()
+}
+
+// doInit does the actual work of initializing a config and returns it.
+// It used to be exported as Init itself; Init is now a thin wrapper
+// that unpacks an InitConfig into this parameter list, so that
+// existing callers only need to migrate to building an InitConfig, not
+// to a different set of initialization steps. See the InitConfig
+// field of the same name for the meaning of each parameter. If localUser is non-empty, libkbfs does
+// not communicate to any remote servers and instead uses fake
+// implementations of various servers.
+func doInit(localUser string, serverRootDir *string, cpuProfilePath, memProfilePath string,
+	blockBackends []BlockBackendConfig, blockReplicaCount int, metricsAddr string, mdPeers []string,
+	mdPeerMe int, mdServerAddr, mdServerTLSCertPath, logLevel, keyringBackend string,
+	onInterruptFn func()) (Config, kv.DB, error) {
+	if logLevel != "" {
+		os.Setenv(envLogLevel, logLevel)
+	}
+
 	if cpuProfilePath != "" {
 		// Let the GC/OS clean up the file handle.
 		f, err := os.Create(cpuProfilePath)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
 		pprof.StartCPUProfile(f)
 	}
@@ -130,24 +237,35 @@ func Init(localUser string, serverRootDir *string, cpuProfilePath, memProfilePat
 
 	config := NewConfigLocal()
 
-	mdServer, err := makeMDServer(config, serverRootDir)
+	// If we have a server root, prefer sharing a single LevelDB
+	// database between the local MD, key, and block servers over the
+	// older one-file-per-table local servers.
+	db, err := openLevelDB(serverRootDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open local leveldb: %v", err)
+	}
+
+	mdServer, err := makeMDServer(config, serverRootDir, db, mdPeers, mdPeerMe,
+		mdServerAddr, mdServerTLSCertPath)
 	if err != nil {
-		return nil, fmt.Errorf("problem creating MD server: %v", err)
+		return nil, nil, fmt.Errorf("problem creating MD server: %v", err)
 	}
 	config.SetMDServer(mdServer)
 
-	keyServer, err := makeKeyServer(config, serverRootDir)
+	keyServer, err := makeKeyServer(config, serverRootDir, db, mdServerAddr)
 	if err != nil {
-		return nil, fmt.Errorf("problem creating key server: %v", err)
+		return nil, nil, fmt.Errorf("problem creating key server: %v", err)
 	}
 	config.SetKeyServer(keyServer)
 
-	bserv, err := makeBlockServer(config, serverRootDir)
+	bserv, err := makeBlockServer(config, serverRootDir, db, blockBackends, blockReplicaCount)
 	if err != nil {
-		return nil, fmt.Errorf("cannot open block database: %v", err)
+		return nil, nil, fmt.Errorf("cannot open block database: %v", err)
 	}
 	config.SetBlockServer(bserv)
 
+	startMetricsServer(metricsAddr)
+
 	libkb.G.Init()
 	libkb.G.ConfigureConfig()
 	libkb.G.ConfigureLogging()
@@ -161,54 +279,248 @@ func Init(localUser string, serverRootDir *string, cpuProfilePath, memProfilePat
 		libkb.G.ConfigureSocketInfo()
 		k, err := NewKBPKIClient(libkb.G)
 		if err != nil {
-			return nil, fmt.Errorf("Could not get KBPKI: %v", err)
+			return nil, nil, fmt.Errorf("Could not get KBPKI: %v", err)
 		}
 		config.SetKBPKI(k)
 
 		c, err := NewCryptoClient(config.Codec(), libkb.G)
 		if err != nil {
-			return nil, fmt.Errorf("Could not get Crypto: %v", err)
+			return nil, nil, fmt.Errorf("Could not get Crypto: %v", err)
 		}
 		config.SetCrypto(c)
 
-		return config, nil
+		return config, db, nil
 	}
 
 	// localUser != ""
 
-	users := []string{"strib", "max", "chris", "fred"}
-	userIndex := -1
-	for i := range users {
-		if localUser == users[i] {
-			userIndex = i
-			break
-		}
-	}
-	if userIndex < 0 {
-		return nil, fmt.Errorf("user %s not in list %v", localUser, users)
+	if keyringBackend == "" {
+		keyringBackend = "memory"
 	}
 
-	localUsers := MakeLocalUsers(users)
+	if keyringBackend == "memory" {
+		users := []string{"strib", "max", "chris", "fred"}
+		userIndex := -1
+		for i := range users {
+			if localUser == users[i] {
+				userIndex = i
+				break
+			}
+		}
+		if userIndex < 0 {
+			return nil, nil, fmt.Errorf("user %s not in list %v", localUser, users)
+		}
+
+		localUsers := MakeLocalUsers(users)
+
+		// TODO: Auto-generate these, too?
+		localUsers[0].Asserts = []string{"github:strib"}
+		localUsers[1].Asserts = []string{"twitter:maxtaco"}
+		localUsers[2].Asserts = []string{"twitter:malgorithms"}
+		localUsers[3].Asserts = []string{"twitter:fakalin"}
+
+		localUID := localUsers[userIndex].UID
+
+		k := NewKBPKILocal(localUID, localUsers)
+		config.SetKBPKI(k)
 
-	// TODO: Auto-generate these, too?
-	localUsers[0].Asserts = []string{"github:strib"}
-	localUsers[1].Asserts = []string{"twitter:maxtaco"}
-	localUsers[2].Asserts = []string{"twitter:malgorithms"}
-	localUsers[3].Asserts = []string{"twitter:fakalin"}
+		signingKey := MakeLocalUserSigningKeyOrBust(localUser)
+		cryptPrivateKey := MakeLocalUserCryptPrivateKeyOrBust(localUser)
+		config.SetCrypto(NewCryptoLocal(config.Codec(), signingKey, cryptPrivateKey))
 
-	var localUID keybase1.UID
-	if userIndex >= 0 {
-		localUID = localUsers[userIndex].UID
+		return config, db, nil
 	}
 
+	// A persistent keyring backend: localUser need not be one of the
+	// hard-coded test names, and its keys survive across runs.
+	keyringDir := ""
+	if serverRootDir != nil {
+		keyringDir = *serverRootDir
+	}
+	keyring.PromptPassphrase = func() (string, error) {
+		return libkb.G.UI.GetTerminalUI().PromptPassword(
+			libkb.PromptDescriptorLoginPassphrase, "Keyring passphrase")
+	}
+	kr, err := keyring.New(keyringBackend, keyringDir)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot open keyring backend %q: %v", keyringBackend, err)
+	}
+
+	keys, err := kr.Get(localUser)
+	if err == keyring.ErrNotFound {
+		keys, err = generateKeyPair()
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot generate keys for %s: %v", localUser, err)
+		}
+		if err := kr.Save(localUser, keys); err != nil {
+			return nil, nil, fmt.Errorf("cannot save keys for %s: %v", localUser, err)
+		}
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("cannot look up keys for %s: %v", localUser, err)
+	}
+
+	localUsers := MakeLocalUsers([]string{localUser})
+	localUID := localUsers[0].UID
+
 	k := NewKBPKILocal(localUID, localUsers)
 	config.SetKBPKI(k)
 
-	signingKey := MakeLocalUserSigningKeyOrBust(localUser)
-	cryptPrivateKey := MakeLocalUserCryptPrivateKeyOrBust(localUser)
+	signingKey := signingKeyFromSecret(keys.SigningKey)
+	cryptPrivateKey := cryptPrivateKeyFromSecret(keys.CryptPrivateKey)
 	config.SetCrypto(NewCryptoLocal(config.Codec(), signingKey, cryptPrivateKey))
 
-	return config, nil
+	return config, db, nil
+}
+
+// shutdowner is implemented by server types (e.g. MDServerLevelDB,
+// MDServerPaxos) that need to release resources or drain in-flight
+// RPCs before being replaced or discarded.
+type shutdowner interface {
+	Shutdown()
+}
+
+func shutdownIfPossible(server interface{}) {
+	if s, ok := server.(shutdowner); ok {
+		s.Shutdown()
+	}
+}
+
+// SwappableConfig wraps a Config so that its MDServer, KeyServer, and
+// BlockServer can be hot-swapped for new ones built from a reloaded
+// InitConfig, as Init does on SIGHUP. Swapping drains (via Shutdown)
+// the old servers, and closes the old shared database, before the new
+// ones are built; see reload.
+type SwappableConfig struct {
+	Config
+
+	mu sync.Mutex
+	// db is the shared LevelDB database, if any, backing the current
+	// MDServer/KeyServer/BlockServer; it is owned here (not by any of
+	// the three servers) so that reload can close it exactly once.
+	db kv.DB
+}
+
+func newSwappableConfig(config Config, db kv.DB) *SwappableConfig {
+	return &SwappableConfig{Config: config, db: db}
+}
+
+// reload rebuilds the MD, key, and block servers from cfg and swaps
+// them into place. It shuts down the servers it replaces, and closes
+// the old shared LevelDB database (if any), before opening the new one
+// and replacing it, since both the old and new db may be rooted at the
+// same on-disk directory and hold the same exclusive lock file.
+func (sc *SwappableConfig) reload(cfg *InitConfig) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	shutdownIfPossible(sc.Config.MDServer())
+	shutdownIfPossible(sc.Config.KeyServer())
+	shutdownIfPossible(sc.Config.BlockServer())
+	if sc.db != nil {
+		sc.db.Close()
+		sc.db = nil
+	}
+
+	db, err := openLevelDB(cfg.ServerRootDir)
+	if err != nil {
+		return fmt.Errorf("cannot open local leveldb: %v", err)
+	}
+
+	if cfg.LogLevel != "" {
+		os.Setenv(envLogLevel, cfg.LogLevel)
+		// ConfigureLogging only reads envLogLevel once, at startup, so
+		// it needs to be called again for a new LogLevel to actually
+		// take effect.
+		libkb.G.ConfigureLogging()
+	}
+
+	mdServer, err := makeMDServer(sc.Config, cfg.ServerRootDir, db, cfg.MDPeers, cfg.MDPeerMe,
+		cfg.MDServerAddr, cfg.MDServerTLSCertPath)
+	if err != nil {
+		return fmt.Errorf("problem creating MD server: %v", err)
+	}
+	sc.Config.SetMDServer(mdServer)
+
+	keyServer, err := makeKeyServer(sc.Config, cfg.ServerRootDir, db, cfg.MDServerAddr)
+	if err != nil {
+		return fmt.Errorf("problem creating key server: %v", err)
+	}
+	sc.Config.SetKeyServer(keyServer)
+
+	bserv, err := makeBlockServer(sc.Config, cfg.ServerRootDir, db, cfg.BlockBackends, cfg.BlockReplicaCount)
+	if err != nil {
+		return fmt.Errorf("cannot open block database: %v", err)
+	}
+	sc.Config.SetBlockServer(bserv)
+
+	sc.db = db
+	return nil
+}
+
+// writeHeapProfile writes a heap profile to path, for use both at
+// shutdown and on SIGUSR1.
+func writeHeapProfile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return pprof.WriteHeapProfile(f)
+}
+
+// Init initializes a config from cfg and returns it as a
+// *SwappableConfig. onInterruptFn is called whenever an interrupt
+// signal is received (e.g., if the user hits Ctrl-C).
+//
+// Once started, Init also reloads cfg's source file and hot-swaps the
+// MDServer, KeyServer, and BlockServer on SIGHUP, and writes a heap
+// profile to cfg.MemProfilePath on SIGUSR1 (in addition to the profile
+// Shutdown writes on exit).
+//
+// Init should be called at the beginning of main. Shutdown (see
+// below) should then be called at the end of main (usually via
+// defer).
+func Init(cfg *InitConfig, onInterruptFn func()) (Config, error) {
+	config, db, err := doInit(cfg.LocalUser, cfg.ServerRootDir, cfg.CPUProfilePath,
+		cfg.MemProfilePath, cfg.BlockBackends, cfg.BlockReplicaCount, cfg.MetricsAddr,
+		cfg.MDPeers, cfg.MDPeerMe, cfg.MDServerAddr, cfg.MDServerTLSCertPath, cfg.LogLevel,
+		cfg.KeyringBackend, onInterruptFn)
+	if err != nil {
+		return nil, err
+	}
+
+	sc := newSwappableConfig(config, db)
+
+	if cfg.path != "" {
+		sighupChan := make(chan os.Signal, 1)
+		signal.Notify(sighupChan, syscall.SIGHUP)
+		go func() {
+			for range sighupChan {
+				newCfg, err := LoadInitConfig(cfg.path)
+				if err != nil {
+					libkb.G.Log.Warning("SIGHUP: cannot reload config from %s: %v", cfg.path, err)
+					continue
+				}
+				if err := sc.reload(newCfg); err != nil {
+					libkb.G.Log.Warning("SIGHUP: cannot apply reloaded config: %v", err)
+				}
+			}
+		}()
+	}
+
+	if cfg.MemProfilePath != "" {
+		sigusr1Chan := make(chan os.Signal, 1)
+		signal.Notify(sigusr1Chan, syscall.SIGUSR1)
+		go func() {
+			for range sigusr1Chan {
+				if err := writeHeapProfile(cfg.MemProfilePath); err != nil {
+					libkb.G.Log.Warning("SIGUSR1: cannot write heap profile: %v", err)
+				}
+			}
+		}()
+	}
+
+	return sc, nil
 }
 
 // Shutdown does any necessary shutdown tasks for libkbfs. Shutdown
@@ -217,13 +529,9 @@ func Shutdown(memProfilePath string) error {
 	pprof.StopCPUProfile()
 
 	if memProfilePath != "" {
-		// Let the GC/OS clean up the file handle.
-		f, err := os.Create(memProfilePath)
-		if err != nil {
+		if err := writeHeapProfile(memProfilePath); err != nil {
 			return err
 		}
-
-		pprof.WriteHeapProfile(f)
 	}
 
 	return nil
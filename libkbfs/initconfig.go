@@ -0,0 +1,89 @@
+package libkbfs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// InitConfig collects everything Init previously took as a growing
+// list of positional parameters into a single struct that can be
+// loaded from a JSON or TOML file via the --config flag.
+type InitConfig struct {
+	// LocalUser, if non-empty, makes Init skip all remote servers and
+	// use fake implementations instead, resolving LocalUser's keys via
+	// KeyringBackend.
+	LocalUser string
+
+	// ServerRootDir roots the local MD, key, and block servers. A nil
+	// pointer means in-memory; a pointer to the empty string means the
+	// current working directory.
+	ServerRootDir *string
+
+	// MDServerAddr is the address of the remote MD server (which also
+	// acts as the key server); empty means use a local server instead.
+	MDServerAddr string
+	// MDServerTLSCertPath, if non-empty, is a PEM-encoded certificate
+	// used to validate MDServerAddr's TLS connection.
+	MDServerTLSCertPath string
+
+	// BlockBackends, if non-empty, configures the BlockServer as a
+	// BlockServerMux over those backends.
+	BlockBackends []BlockBackendConfig
+	// BlockReplicaCount caps how many writable BlockBackends a Put is
+	// written to; 0 means "all of them".
+	BlockReplicaCount int
+	// MetricsAddr, if non-empty, serves Prometheus metrics for
+	// BlockBackends at "http://<MetricsAddr>/metrics".
+	MetricsAddr string
+
+	// MDPeers, if non-empty, replicates the local MD server across
+	// those peers' unix sockets via Paxos; MDPeerMe is this process's
+	// index into MDPeers.
+	MDPeers  []string
+	MDPeerMe int
+
+	// KeyringBackend selects which keyring.Keyring backend resolves
+	// LocalUser's signing and crypt keys ("memory", "file", or "os").
+	KeyringBackend string
+
+	// CPUProfilePath and MemProfilePath, if non-empty, are where Init
+	// and Shutdown write CPU and heap profiles.
+	CPUProfilePath string
+	MemProfilePath string
+
+	// LogLevel is the minimum level logged, e.g. "debug", "info",
+	// "warning", or "error". Empty means use the default.
+	LogLevel string
+
+	// path is the file InitConfig was loaded from, if any, kept so
+	// that Init can re-read it on SIGHUP.
+	path string
+}
+
+// LoadInitConfig reads an InitConfig from path, which may be either
+// JSON or TOML; the format is selected by path's extension (".toml"
+// selects TOML; anything else, including no extension, selects JSON).
+func LoadInitConfig(path string) (*InitConfig, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg InitConfig
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		if err := toml.Unmarshal(buf, &cfg); err != nil {
+			return nil, fmt.Errorf("cannot parse %s as TOML: %v", path, err)
+		}
+	} else {
+		if err := json.Unmarshal(buf, &cfg); err != nil {
+			return nil, fmt.Errorf("cannot parse %s as JSON: %v", path, err)
+		}
+	}
+	cfg.path = path
+	return &cfg, nil
+}
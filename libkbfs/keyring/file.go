@@ -0,0 +1,146 @@
+package keyring
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+func init() {
+	Register("file", newFileKeyring)
+}
+
+// PromptPassphrase is called by the "file" backend to obtain the
+// passphrase used to encrypt and decrypt its on-disk keyring. Init
+// sets this to prompt via the existing client.InitUI terminal UI
+// before constructing a "file" Keyring.
+var PromptPassphrase func() (string, error)
+
+const fileKeyringName = "kbfs_keyring"
+
+// fileKeyring is a Keyring that stores every user's KeyPair as a
+// single encrypted JSON blob under dir, encrypted with a key derived
+// from a passphrase via scrypt and sealed with NaCl secretbox.
+type fileKeyring struct {
+	mu   sync.Mutex
+	path string
+	salt []byte
+	key  [32]byte
+	keys map[string]KeyPair
+}
+
+func newFileKeyring(dir string) (Keyring, error) {
+	if PromptPassphrase == nil {
+		return nil, fmt.Errorf("keyring: file backend requires PromptPassphrase to be set")
+	}
+	passphrase, err := PromptPassphrase()
+	if err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, fileKeyringName)
+	fk := &fileKeyring{path: path, keys: make(map[string]KeyPair)}
+
+	buf, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		if err := fk.deriveKey(passphrase, salt); err != nil {
+			return nil, err
+		}
+		fk.salt = salt
+		return fk, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if len(buf) < 16 {
+		return nil, fmt.Errorf("keyring: %s is too short to be a valid keyring file", path)
+	}
+	salt := buf[:16]
+	sealed := buf[16:]
+	if err := fk.deriveKey(passphrase, salt); err != nil {
+		return nil, err
+	}
+	fk.salt = salt
+
+	if len(sealed) < 24 {
+		return nil, fmt.Errorf("keyring: %s is too short to be a valid keyring file", path)
+	}
+	var nonce [24]byte
+	copy(nonce[:], sealed[:24])
+	plain, ok := secretbox.Open(nil, sealed[24:], &nonce, &fk.key)
+	if !ok {
+		return nil, fmt.Errorf("keyring: could not decrypt %s; wrong passphrase?", path)
+	}
+	if err := json.Unmarshal(plain, &fk.keys); err != nil {
+		return nil, err
+	}
+	return fk, nil
+}
+
+func (fk *fileKeyring) deriveKey(passphrase string, salt []byte) error {
+	derived, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return err
+	}
+	copy(fk.key[:], derived)
+	return nil
+}
+
+func (fk *fileKeyring) saveLocked() error {
+	plain, err := json.Marshal(fk.keys)
+	if err != nil {
+		return err
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return err
+	}
+	sealed := secretbox.Seal(nonce[:], plain, &nonce, &fk.key)
+	buf := append(append([]byte{}, fk.salt...), sealed...)
+	return ioutil.WriteFile(fk.path, buf, 0600)
+}
+
+func (fk *fileKeyring) List() ([]string, error) {
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+	names := make([]string, 0, len(fk.keys))
+	for name := range fk.keys {
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (fk *fileKeyring) Get(name string) (KeyPair, error) {
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+	keys, ok := fk.keys[name]
+	if !ok {
+		return KeyPair{}, ErrNotFound
+	}
+	return keys, nil
+}
+
+func (fk *fileKeyring) Save(name string, keys KeyPair) error {
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+	fk.keys[name] = keys
+	return fk.saveLocked()
+}
+
+func (fk *fileKeyring) Delete(name string) error {
+	fk.mu.Lock()
+	defer fk.mu.Unlock()
+	delete(fk.keys, name)
+	return fk.saveLocked()
+}
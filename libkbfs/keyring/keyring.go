@@ -0,0 +1,76 @@
+// Package keyring abstracts over where libkbfs's local signing and
+// crypt keys for a given user name come from, so that Init can resolve
+// a local identity without being limited to the four hard-coded test
+// users it used to recognize.
+//
+// Keyring deliberately knows nothing about libkbfs's own SigningKey and
+// CryptPrivateKey types (to avoid an import cycle, since those live in
+// the libkbfs package that consumes this one); it deals only in the
+// raw NaCl secret key bytes that back them, which callers convert to
+// and from their own key types.
+package keyring
+
+import (
+	"fmt"
+	"sync"
+)
+
+// KeySize is the length, in bytes, of each of the raw secret keys this
+// package stores.
+const KeySize = 32
+
+// KeyPair is the raw NaCl secret key material for one user: a signing
+// (Ed25519) key and a crypt (Curve25519) key.
+type KeyPair struct {
+	SigningKey      [KeySize]byte
+	CryptPrivateKey [KeySize]byte
+}
+
+// Keyring stores and retrieves a KeyPair per user name.
+type Keyring interface {
+	// List returns the names of every user this Keyring has keys for.
+	List() ([]string, error)
+	// Get returns the key pair for name.
+	Get(name string) (KeyPair, error)
+	// Save stores (or overwrites) the key pair for name.
+	Save(name string, keys KeyPair) error
+	// Delete removes the key pair for name, if any.
+	Delete(name string) error
+}
+
+// Factory builds a Keyring given a directory to root any on-disk state
+// in (meaningful only to backends that use one).
+type Factory func(dir string) (Keyring, error)
+
+var (
+	backendsMu sync.Mutex
+	backends   = map[string]Factory{}
+)
+
+// Register makes a Keyring backend available under name, for use as
+// the --keyring-backend flag value. It is meant to be called from the
+// init() function of a package implementing a Keyring.
+func Register(name string, factory Factory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[name] = factory
+}
+
+// New returns the Keyring registered under name, rooted at dir.
+func New(name, dir string) (Keyring, error) {
+	backendsMu.Lock()
+	factory, ok := backends[name]
+	backendsMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("keyring: no backend registered under %q", name)
+	}
+	return factory(dir)
+}
+
+// ErrNotFound is returned by Get when name has no keys. Delete of a
+// name with no keys is not an error.
+var ErrNotFound = keyringError("keyring: user not found")
+
+type keyringError string
+
+func (e keyringError) Error() string { return string(e) }
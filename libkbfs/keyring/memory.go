@@ -0,0 +1,58 @@
+package keyring
+
+import (
+	"sort"
+	"sync"
+)
+
+func init() {
+	Register("memory", newMemoryKeyring)
+}
+
+// memoryKeyring is a Keyring that never persists anything; its keys
+// last only as long as the process. libkbfs's Init handles the
+// "memory" backend itself, with its hard-coded test users, and does
+// not construct a memoryKeyring.
+type memoryKeyring struct {
+	mu   sync.RWMutex
+	keys map[string]KeyPair
+}
+
+func newMemoryKeyring(dir string) (Keyring, error) {
+	return &memoryKeyring{keys: make(map[string]KeyPair)}, nil
+}
+
+func (k *memoryKeyring) List() ([]string, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	names := make([]string, 0, len(k.keys))
+	for name := range k.keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (k *memoryKeyring) Get(name string) (KeyPair, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	keys, ok := k.keys[name]
+	if !ok {
+		return KeyPair{}, ErrNotFound
+	}
+	return keys, nil
+}
+
+func (k *memoryKeyring) Save(name string, keys KeyPair) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys[name] = keys
+	return nil
+}
+
+func (k *memoryKeyring) Delete(name string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	delete(k.keys, name)
+	return nil
+}
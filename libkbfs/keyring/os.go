@@ -0,0 +1,105 @@
+package keyring
+
+import (
+	"encoding/base64"
+	"strings"
+
+	"github.com/zalando/go-keyring"
+)
+
+func init() {
+	Register("os", newOSKeyring)
+}
+
+// osKeyringService is the service name under which osKeyring stores
+// its entries in the platform keychain (macOS Keychain, Secret
+// Service, or Windows Credential Manager, depending on OS).
+const osKeyringService = "kbfs"
+
+// osKeyring is a Keyring backed by the platform's native credential
+// store, via zalando/go-keyring. There's no listing API in the
+// underlying library, so osKeyring also keeps a small index entry
+// under a fixed account name to track which users have been saved.
+type osKeyring struct{}
+
+func newOSKeyring(dir string) (Keyring, error) {
+	return osKeyring{}, nil
+}
+
+const osKeyringIndexAccount = "\x00index"
+
+func (k osKeyring) index() ([]string, error) {
+	val, err := keyring.Get(osKeyringService, osKeyringIndexAccount)
+	if err == keyring.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if val == "" {
+		return nil, nil
+	}
+	return strings.Split(val, ","), nil
+}
+
+func (k osKeyring) setIndex(names []string) error {
+	return keyring.Set(osKeyringService, osKeyringIndexAccount, strings.Join(names, ","))
+}
+
+func (k osKeyring) List() ([]string, error) {
+	return k.index()
+}
+
+func (k osKeyring) Get(name string) (KeyPair, error) {
+	val, err := keyring.Get(osKeyringService, name)
+	if err == keyring.ErrNotFound {
+		return KeyPair{}, ErrNotFound
+	}
+	if err != nil {
+		return KeyPair{}, err
+	}
+	raw, err := base64.StdEncoding.DecodeString(val)
+	if err != nil || len(raw) != 2*KeySize {
+		return KeyPair{}, ErrNotFound
+	}
+	var keys KeyPair
+	copy(keys.SigningKey[:], raw[:KeySize])
+	copy(keys.CryptPrivateKey[:], raw[KeySize:])
+	return keys, nil
+}
+
+func (k osKeyring) Save(name string, keys KeyPair) error {
+	raw := append(append([]byte{}, keys.SigningKey[:]...), keys.CryptPrivateKey[:]...)
+	if err := keyring.Set(osKeyringService, name, base64.StdEncoding.EncodeToString(raw)); err != nil {
+		return err
+	}
+
+	names, err := k.index()
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if n == name {
+			return nil
+		}
+	}
+	return k.setIndex(append(names, name))
+}
+
+func (k osKeyring) Delete(name string) error {
+	if err := keyring.Delete(osKeyringService, name); err != nil && err != keyring.ErrNotFound {
+		return err
+	}
+
+	names, err := k.index()
+	if err != nil {
+		return err
+	}
+	filtered := names[:0]
+	for _, n := range names {
+		if n != name {
+			filtered = append(filtered, n)
+		}
+	}
+	return k.setIndex(filtered)
+}
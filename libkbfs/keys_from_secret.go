@@ -0,0 +1,37 @@
+package libkbfs
+
+import (
+	"crypto/rand"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/libkbfs/keyring"
+)
+
+// signingKeyFromSecret and cryptPrivateKeyFromSecret build the same
+// SigningKey/CryptPrivateKey types that MakeLocalUserSigningKeyOrBust
+// and MakeLocalUserCryptPrivateKeyOrBust do, but from caller-supplied
+// secret bytes rather than ones derived from a user name. This lets a
+// keyring.Keyring hand back arbitrary persisted keys instead of only
+// the four hard-coded test identities.
+func signingKeyFromSecret(secret [keyring.KeySize]byte) SigningKey {
+	kp := libkb.MakeNaclSigningKeyPairFromSecretBytes(secret)
+	return SigningKey{kp}
+}
+
+func cryptPrivateKeyFromSecret(secret [keyring.KeySize]byte) CryptPrivateKey {
+	kp := libkb.MakeNaclCryptKeyPairFromSecretBytes(secret)
+	return CryptPrivateKey{kp}
+}
+
+// generateKeyPair creates a fresh random KeyPair, for a keyring backend
+// to persist the first time it sees a given user name.
+func generateKeyPair() (keyring.KeyPair, error) {
+	var kp keyring.KeyPair
+	if _, err := rand.Read(kp.SigningKey[:]); err != nil {
+		return kp, err
+	}
+	if _, err := rand.Read(kp.CryptPrivateKey[:]); err != nil {
+		return kp, err
+	}
+	return kp, nil
+}
@@ -0,0 +1,52 @@
+// Package kv defines a small embedded key-value store abstraction used
+// by libkbfs's local server implementations, so that the on-disk format
+// (currently LevelDB) can be swapped out without touching the servers
+// that sit on top of it.
+package kv
+
+// DB is a minimal embedded key-value store. Implementations are
+// expected to be safe for concurrent use by multiple goroutines.
+type DB interface {
+	// Get returns the value for key, or ErrNotFound if it doesn't exist.
+	Get(key []byte) ([]byte, error)
+	// Put sets the value for key, overwriting any existing value.
+	Put(key, value []byte) error
+	// Delete removes key. It is not an error to delete a missing key.
+	Delete(key []byte) error
+	// NewBatch returns a Batch that can be used to group writes into a
+	// single atomic operation via Write.
+	NewBatch() Batch
+	// Write atomically applies all operations queued in b.
+	Write(b Batch) error
+	// NewIterator returns an Iterator over all keys with the given
+	// prefix, in ascending key order.
+	NewIterator(prefix []byte) Iterator
+	// Close releases any resources held by the DB.
+	Close() error
+}
+
+// Batch collects a group of Put/Delete operations to be applied
+// atomically by DB.Write.
+type Batch interface {
+	Put(key, value []byte)
+	Delete(key []byte)
+	Reset()
+}
+
+// Iterator walks a range of key-value pairs in ascending key order.
+// Callers must call Release when done.
+type Iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Error() error
+	Release()
+}
+
+// ErrNotFound is returned by DB.Get when the requested key does not
+// exist.
+var ErrNotFound = dbError("kv: key not found")
+
+type dbError string
+
+func (e dbError) Error() string { return string(e) }
@@ -0,0 +1,76 @@
+package kv
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// levelDB is a DB backed by a single syndtr/goleveldb database.
+type levelDB struct {
+	db *leveldb.DB
+}
+
+// OpenLevelDB opens (creating if necessary) a LevelDB database rooted
+// at dir and wraps it as a DB.
+func OpenLevelDB(dir string) (DB, error) {
+	db, err := leveldb.OpenFile(dir, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &levelDB{db: db}, nil
+}
+
+func (l *levelDB) Get(key []byte) ([]byte, error) {
+	value, err := l.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (l *levelDB) Put(key, value []byte) error {
+	return l.db.Put(key, value, nil)
+}
+
+func (l *levelDB) Delete(key []byte) error {
+	return l.db.Delete(key, nil)
+}
+
+func (l *levelDB) NewBatch() Batch {
+	return &levelDBBatch{batch: new(leveldb.Batch)}
+}
+
+func (l *levelDB) Write(b Batch) error {
+	lb, ok := b.(*levelDBBatch)
+	if !ok {
+		return dbError("kv: batch from a different DB implementation")
+	}
+	return l.db.Write(lb.batch, nil)
+}
+
+func (l *levelDB) NewIterator(prefix []byte) Iterator {
+	return &levelDBIterator{iter: l.db.NewIterator(util.BytesPrefix(prefix), nil)}
+}
+
+func (l *levelDB) Close() error {
+	return l.db.Close()
+}
+
+type levelDBBatch struct {
+	batch *leveldb.Batch
+}
+
+func (b *levelDBBatch) Put(key, value []byte) { b.batch.Put(key, value) }
+func (b *levelDBBatch) Delete(key []byte)      { b.batch.Delete(key) }
+func (b *levelDBBatch) Reset()                 { b.batch.Reset() }
+
+type levelDBIterator struct {
+	iter iterator.Iterator
+}
+
+func (i *levelDBIterator) Next() bool    { return i.iter.Next() }
+func (i *levelDBIterator) Key() []byte   { return i.iter.Key() }
+func (i *levelDBIterator) Value() []byte { return i.iter.Value() }
+func (i *levelDBIterator) Error() error  { return i.iter.Error() }
+func (i *levelDBIterator) Release()      { i.iter.Release() }
@@ -0,0 +1,298 @@
+package libkbfs
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/keybase/client/go/libkbfs/kv"
+	"github.com/keybase/client/protocol/go"
+	"golang.org/x/net/context"
+)
+
+// Key prefixes used to partition the single shared LevelDB database
+// among the MD, key, and block servers.
+var (
+	mdServerHandlePrefix = []byte("handle/")
+	mdServerMDPrefix     = []byte("md/")
+	mdServerRevPrefix    = []byte("rev/")
+	mdServerLockPrefix   = []byte("lock/")
+	keyServerPrefix      = []byte("key/")
+	blockServerPrefix    = []byte("block/")
+)
+
+// MDServerLevelDB is a MDServer implementation that stores all of its
+// data in a shared kv.DB, under the md/, rev/, and lock/ key prefixes;
+// handleKey builds handle/ keys, but no method reads or writes them.
+// Unlike MDServerLocal, which writes each of those to its
+// own file, MDServerLevelDB gets crash-safe persistence and atomic
+// batched writes (for example, writing a new MD revision and updating
+// its associated rev/ pointer) from the underlying store, plus an
+// iterator over rev/ for range queries.
+type MDServerLevelDB struct {
+	config Config
+	db     kv.DB
+}
+
+// NewMDServerLevelDB returns a MDServerLevelDB that stores its data in
+// db, which may be shared with a KeyServerLevelDB and/or
+// BlockServerLevelDB rooted at the same directory.
+func NewMDServerLevelDB(config Config, db kv.DB) (*MDServerLevelDB, error) {
+	return &MDServerLevelDB{config: config, db: db}, nil
+}
+
+func (md *MDServerLevelDB) handleKey(id TlfID) []byte {
+	return append(append([]byte{}, mdServerHandlePrefix...), id.Bytes()...)
+}
+
+// mdKey is the key under which the encoded RootMetadataSigned for
+// (id, rev) is stored.
+func (md *MDServerLevelDB) mdKey(id TlfID, rev MetadataRevision) []byte {
+	key := append([]byte{}, mdServerMDPrefix...)
+	key = append(key, id.Bytes()...)
+	return append(key, rev.Bytes()...)
+}
+
+// revPrefix scopes an iterator to every revision recorded for (id,
+// branch), in ascending revision order (since rev.Bytes() is a
+// fixed-width big-endian encoding).
+func (md *MDServerLevelDB) revPrefix(id TlfID, branch BranchID) []byte {
+	key := append([]byte{}, mdServerRevPrefix...)
+	key = append(key, id.Bytes()...)
+	return append(key, branch.Bytes()...)
+}
+
+// revKey is the key under which rev's own bytes are stored (as the
+// value), so that GetForTLF and GetRange can map a rev/ iterator
+// position straight back to the corresponding mdKey without having to
+// parse a MetadataRevision out of raw bytes.
+func (md *MDServerLevelDB) revKey(id TlfID, branch BranchID, rev MetadataRevision) []byte {
+	return append(md.revPrefix(id, branch), rev.Bytes()...)
+}
+
+func (md *MDServerLevelDB) lockKey(id TlfID) []byte {
+	return append(append([]byte{}, mdServerLockPrefix...), id.Bytes()...)
+}
+
+// PutMD stores rmds, and atomically records it as the latest revision
+// for its (TLF, branch), via a single batched write.
+func (md *MDServerLevelDB) PutMD(id TlfID, rmds *RootMetadataSigned) error {
+	buf, err := md.config.Codec().Encode(rmds)
+	if err != nil {
+		return err
+	}
+
+	rev := rmds.Revision()
+	bid := rmds.BranchID()
+
+	batch := md.db.NewBatch()
+	batch.Put(md.mdKey(id, rev), buf)
+	batch.Put(md.revKey(id, bid, rev), rev.Bytes())
+	return md.db.Write(batch)
+}
+
+// GetForTLF returns the most recent RootMetadataSigned for (id,
+// branch), or nil if there isn't one yet.
+func (md *MDServerLevelDB) GetForTLF(id TlfID, bid BranchID) (*RootMetadataSigned, error) {
+	iter := md.db.NewIterator(md.revPrefix(id, bid))
+	defer iter.Release()
+
+	var latestRevBytes []byte
+	for iter.Next() {
+		latestRevBytes = append([]byte{}, iter.Value()...)
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	if latestRevBytes == nil {
+		return nil, nil
+	}
+
+	return md.getByRevBytes(id, latestRevBytes)
+}
+
+// GetRange returns every RootMetadataSigned for (id, branch) whose
+// revision falls within [start, stop], in ascending revision order.
+func (md *MDServerLevelDB) GetRange(id TlfID, bid BranchID, start, stop MetadataRevision) (
+	[]*RootMetadataSigned, error) {
+	iter := md.db.NewIterator(md.revPrefix(id, bid))
+	defer iter.Release()
+
+	startBytes := start.Bytes()
+	stopBytes := stop.Bytes()
+
+	var result []*RootMetadataSigned
+	for iter.Next() {
+		revBytes := iter.Value()
+		if bytes.Compare(revBytes, startBytes) < 0 || bytes.Compare(revBytes, stopBytes) > 0 {
+			continue
+		}
+		rmds, err := md.getByRevBytes(id, revBytes)
+		if err != nil {
+			return nil, err
+		}
+		if rmds != nil {
+			result = append(result, rmds)
+		}
+	}
+	if err := iter.Error(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (md *MDServerLevelDB) getByRevBytes(id TlfID, revBytes []byte) (*RootMetadataSigned, error) {
+	key := append(append([]byte{}, mdServerMDPrefix...), id.Bytes()...)
+	key = append(key, revBytes...)
+
+	buf, err := md.db.Get(key)
+	if err == kv.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rmds RootMetadataSigned
+	if err := md.config.Codec().Decode(buf, &rmds); err != nil {
+		return nil, err
+	}
+	return &rmds, nil
+}
+
+// PruneBranch removes every revision recorded for (id, bid), in one
+// atomic batch.
+func (md *MDServerLevelDB) PruneBranch(id TlfID, bid BranchID) error {
+	iter := md.db.NewIterator(md.revPrefix(id, bid))
+	defer iter.Release()
+
+	batch := md.db.NewBatch()
+	for iter.Next() {
+		revBytes := append([]byte{}, iter.Value()...)
+		batch.Delete(append([]byte{}, iter.Key()...))
+
+		mdKey := append(append([]byte{}, mdServerMDPrefix...), id.Bytes()...)
+		mdKey = append(mdKey, revBytes...)
+		batch.Delete(mdKey)
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+	return md.db.Write(batch)
+}
+
+// TruncateLock attempts to acquire the truncate lock for id on behalf
+// of uid, returning whether the lock is now held by uid (which is true
+// both when this call acquired it and when uid already held it).
+func (md *MDServerLevelDB) TruncateLock(id TlfID, uid keybase1.UID) (bool, error) {
+	key := md.lockKey(id)
+	existing, err := md.db.Get(key)
+	if err != nil && err != kv.ErrNotFound {
+		return false, err
+	}
+	if err == nil && string(existing) != string(uid) {
+		return false, nil
+	}
+	if err := md.db.Put(key, []byte(uid)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Shutdown implements the MDServer interface for MDServerLevelDB. It
+// does not close db, since db may be shared with a KeyServerLevelDB
+// and/or BlockServerLevelDB rooted at the same directory; whoever
+// opened db (see openLevelDB) owns closing it.
+func (md *MDServerLevelDB) Shutdown() {
+}
+
+// KeyServerLevelDB is a KeyServer implementation that stores server
+// half key halves in a shared kv.DB under the key/ prefix, in place of
+// KeyServerLocal's flat file.
+type KeyServerLevelDB struct {
+	config Config
+	db     kv.DB
+}
+
+// NewKeyServerLevelDB returns a KeyServerLevelDB backed by db.
+func NewKeyServerLevelDB(config Config, db kv.DB) (*KeyServerLevelDB, error) {
+	return &KeyServerLevelDB{config: config, db: db}, nil
+}
+
+func (ks *KeyServerLevelDB) keyKey(serverHalfID TLFCryptKeyServerHalfID) []byte {
+	return append(append([]byte{}, keyServerPrefix...), serverHalfID.Bytes()...)
+}
+
+// GetTLFCryptKeyServerHalf returns the server half previously stored
+// under serverHalfID.
+func (ks *KeyServerLevelDB) GetTLFCryptKeyServerHalf(serverHalfID TLFCryptKeyServerHalfID) (
+	TLFCryptKeyServerHalf, error) {
+	buf, err := ks.db.Get(ks.keyKey(serverHalfID))
+	if err == kv.ErrNotFound {
+		return TLFCryptKeyServerHalf{}, fmt.Errorf("no server-side key half for %v", serverHalfID)
+	}
+	if err != nil {
+		return TLFCryptKeyServerHalf{}, err
+	}
+
+	var half TLFCryptKeyServerHalf
+	if err := ks.config.Codec().Decode(buf, &half); err != nil {
+		return TLFCryptKeyServerHalf{}, err
+	}
+	return half, nil
+}
+
+// PutTLFCryptKeyServerHalf stores half under serverHalfID.
+func (ks *KeyServerLevelDB) PutTLFCryptKeyServerHalf(
+	serverHalfID TLFCryptKeyServerHalfID, half TLFCryptKeyServerHalf) error {
+	buf, err := ks.config.Codec().Encode(half)
+	if err != nil {
+		return err
+	}
+	return ks.db.Put(ks.keyKey(serverHalfID), buf)
+}
+
+// Shutdown implements the KeyServer interface for KeyServerLevelDB. It
+// does not close db; see MDServerLevelDB.Shutdown.
+func (ks *KeyServerLevelDB) Shutdown() {
+}
+
+// BlockServerLevelDB is a BlockServer implementation that stores block
+// data in a shared kv.DB under the block/ prefix, in place of
+// BlockServerLocal's directory-per-block layout.
+type BlockServerLevelDB struct {
+	config Config
+	db     kv.DB
+}
+
+// NewBlockServerLevelDB returns a BlockServerLevelDB backed by db.
+func NewBlockServerLevelDB(config Config, db kv.DB) (*BlockServerLevelDB, error) {
+	return &BlockServerLevelDB{config: config, db: db}, nil
+}
+
+func (bs *BlockServerLevelDB) blockKey(id BlockID) []byte {
+	return append(append([]byte{}, blockServerPrefix...), id.Bytes()...)
+}
+
+// GetRaw returns the raw data previously stored for id.
+func (bs *BlockServerLevelDB) GetRaw(ctx context.Context, id BlockID) ([]byte, error) {
+	buf, err := bs.db.Get(bs.blockKey(id))
+	if err == kv.ErrNotFound {
+		return nil, BServerErrorBlockNonExistent{}
+	}
+	return buf, err
+}
+
+// PutRaw stores buf as the raw data for id.
+func (bs *BlockServerLevelDB) PutRaw(ctx context.Context, id BlockID, buf []byte) error {
+	return bs.db.Put(bs.blockKey(id), buf)
+}
+
+// DeleteRaw removes id. It is not an error to delete a missing block.
+func (bs *BlockServerLevelDB) DeleteRaw(ctx context.Context, id BlockID) error {
+	return bs.db.Delete(bs.blockKey(id))
+}
+
+// Shutdown implements the BlockServer interface for BlockServerLevelDB.
+// It does not close db; see MDServerLevelDB.Shutdown.
+func (bs *BlockServerLevelDB) Shutdown() {
+}
@@ -0,0 +1,163 @@
+package libkbfs
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/keybase/client/go/libkbfs/kv"
+	"github.com/keybase/client/protocol/go"
+	"golang.org/x/net/context"
+)
+
+// openTestLevelDB returns a kv.DB backed by a fresh, empty temp
+// directory, and a cleanup func that closes it and removes the
+// directory.
+func openTestLevelDB(t *testing.T) (kv.DB, func()) {
+	dir, err := ioutil.TempDir("", "libkbfs-leveldb-test")
+	if err != nil {
+		t.Fatalf("TempDir: %v", err)
+	}
+	db, err := kv.OpenLevelDB(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("OpenLevelDB: %v", err)
+	}
+	return db, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBlockServerLevelDBRoundTrip(t *testing.T) {
+	db, cleanup := openTestLevelDB(t)
+	defer cleanup()
+
+	bs, err := NewBlockServerLevelDB(NewConfigLocal(), db)
+	if err != nil {
+		t.Fatalf("NewBlockServerLevelDB: %v", err)
+	}
+
+	var id BlockID
+	ctx := context.Background()
+
+	if _, err := bs.GetRaw(ctx, id); err == nil {
+		t.Fatal("expected an error reading a block that was never written")
+	}
+
+	want := []byte("block contents")
+	if err := bs.PutRaw(ctx, id, want); err != nil {
+		t.Fatalf("PutRaw: %v", err)
+	}
+
+	got, err := bs.GetRaw(ctx, id)
+	if err != nil {
+		t.Fatalf("GetRaw: %v", err)
+	}
+	if string(got) != string(want) {
+		t.Fatalf("GetRaw = %q, want %q", got, want)
+	}
+
+	if err := bs.DeleteRaw(ctx, id); err != nil {
+		t.Fatalf("DeleteRaw: %v", err)
+	}
+	if _, err := bs.GetRaw(ctx, id); err == nil {
+		t.Fatal("expected an error reading a block that was just deleted")
+	}
+	// Deleting an already-missing block is not an error.
+	if err := bs.DeleteRaw(ctx, id); err != nil {
+		t.Fatalf("DeleteRaw of a missing block returned an error: %v", err)
+	}
+}
+
+func TestMDServerLevelDBPutAndGetForTLF(t *testing.T) {
+	db, cleanup := openTestLevelDB(t)
+	defer cleanup()
+
+	config := NewConfigLocal()
+	md, err := NewMDServerLevelDB(config, db)
+	if err != nil {
+		t.Fatalf("NewMDServerLevelDB: %v", err)
+	}
+
+	var id TlfID
+	var bid BranchID
+
+	if got, err := md.GetForTLF(id, bid); err != nil || got != nil {
+		t.Fatalf("GetForTLF on an empty store = (%v, %v), want (nil, nil)", got, err)
+	}
+
+	rmds := &RootMetadataSigned{}
+	if err := md.PutMD(id, rmds); err != nil {
+		t.Fatalf("PutMD: %v", err)
+	}
+
+	got, err := md.GetForTLF(id, bid)
+	if err != nil {
+		t.Fatalf("GetForTLF: %v", err)
+	}
+	if got == nil {
+		t.Fatal("GetForTLF returned nil after a PutMD")
+	}
+
+	if err := md.PruneBranch(id, bid); err != nil {
+		t.Fatalf("PruneBranch: %v", err)
+	}
+	if got, err := md.GetForTLF(id, bid); err != nil || got != nil {
+		t.Fatalf("GetForTLF after PruneBranch = (%v, %v), want (nil, nil)", got, err)
+	}
+}
+
+func TestMDServerLevelDBTruncateLock(t *testing.T) {
+	db, cleanup := openTestLevelDB(t)
+	defer cleanup()
+
+	md, err := NewMDServerLevelDB(NewConfigLocal(), db)
+	if err != nil {
+		t.Fatalf("NewMDServerLevelDB: %v", err)
+	}
+
+	var id TlfID
+	var uid keybase1.UID
+
+	acquired, err := md.TruncateLock(id, uid)
+	if err != nil {
+		t.Fatalf("TruncateLock: %v", err)
+	}
+	if !acquired {
+		t.Fatal("expected the first TruncateLock call to acquire the lock")
+	}
+
+	// The same user re-acquiring the lock it already holds should
+	// still report success.
+	again, err := md.TruncateLock(id, uid)
+	if err != nil {
+		t.Fatalf("TruncateLock (re-acquire): %v", err)
+	}
+	if !again {
+		t.Fatal("expected the lock's existing holder to be able to re-acquire it")
+	}
+}
+
+func TestKeyServerLevelDBRoundTrip(t *testing.T) {
+	db, cleanup := openTestLevelDB(t)
+	defer cleanup()
+
+	ks, err := NewKeyServerLevelDB(NewConfigLocal(), db)
+	if err != nil {
+		t.Fatalf("NewKeyServerLevelDB: %v", err)
+	}
+
+	var id TLFCryptKeyServerHalfID
+	if _, err := ks.GetTLFCryptKeyServerHalf(id); err == nil {
+		t.Fatal("expected an error reading a key half that was never written")
+	}
+
+	var half TLFCryptKeyServerHalf
+	if err := ks.PutTLFCryptKeyServerHalf(id, half); err != nil {
+		t.Fatalf("PutTLFCryptKeyServerHalf: %v", err)
+	}
+	if _, err := ks.GetTLFCryptKeyServerHalf(id); err != nil {
+		t.Fatalf("GetTLFCryptKeyServerHalf: %v", err)
+	}
+}
@@ -0,0 +1,343 @@
+package libkbfs
+
+import (
+	"fmt"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/keybase/client/go/libkb"
+	"github.com/keybase/client/go/libkbfs/kv"
+	"github.com/keybase/client/protocol/go"
+)
+
+// mdPaxosOp is a single mutating MDServer operation, serialized through
+// the Paxos log so that every peer applies the same ops in the same
+// order. Only one of the fields is meaningful per op, selected by Kind.
+type mdPaxosOp struct {
+	Kind string // "put", "pruneBranch", or "truncateLock"
+
+	// Nonce identifies the propose call that produced this op, so that
+	// propose can tell whether its own op is the one that was decided
+	// for a given paxos seq. It can't compare Kind plus the per-kind
+	// fields for that, since PruneBranch and TruncateLock don't set ID,
+	// so two peers proposing different PruneBranch (or TruncateLock)
+	// ops commonly collide on the same seq (every peer's nextSeq starts
+	// at 1 and advances independently).
+	Nonce mdPaxosNonce
+
+	// PutMD
+	ID  TlfID
+	RMD *RootMetadataSigned
+
+	// PruneBranch
+	BID     BranchID
+	PBTlfID TlfID
+
+	// TruncateLock
+	LockTlfID TlfID
+	LockUser  keybase1.UID
+}
+
+// mdPaxosNonce identifies one propose call across the whole cluster:
+// Peer picks who proposed it, and Counter (unique per peer) picks
+// which of that peer's proposals it is, so no two propose calls ever
+// share a nonce even when they race on the same paxos seq.
+type mdPaxosNonce struct {
+	Peer    int
+	Counter uint64
+}
+
+// MDServerPaxosRPC is the net/rpc-visible surface of a paxosLog peer,
+// exposed over a unix socket so that other peers in the cluster can
+// reach this one.
+type MDServerPaxosRPC struct {
+	server *MDServerPaxos
+}
+
+// Prepare handles an incoming Paxos Prepare request.
+func (r *MDServerPaxosRPC) Prepare(args PrepareArgs, reply *PrepareReply) error {
+	*reply = r.server.log.handlePrepare(args)
+	return nil
+}
+
+// Accept handles an incoming Paxos Accept request.
+func (r *MDServerPaxosRPC) Accept(args AcceptArgs, reply *AcceptReply) error {
+	*reply = r.server.log.handleAccept(args)
+	return nil
+}
+
+// Decided handles an incoming Paxos Decided broadcast, applying ops to
+// the local store once every instance up to this one has decided.
+func (r *MDServerPaxosRPC) Decided(args DecidedArgs, _ *struct{}) error {
+	r.server.log.handleDecided(args)
+	r.server.applyDecidedLocked(args.Seq, args.V)
+	return nil
+}
+
+// rpcPaxosPeer implements paxosPeer over a net/rpc client connected to
+// a peer's unix socket. Peers are dialed lazily and redialed on error,
+// since a peer may not be up yet (or may restart) during the lifetime
+// of the cluster.
+type rpcPaxosPeer struct {
+	mu       sync.Mutex
+	sockPath string
+	client   *rpc.Client
+}
+
+func (p *rpcPaxosPeer) call(method string, args, reply interface{}) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.client == nil {
+		conn, err := net.Dial("unix", p.sockPath)
+		if err != nil {
+			return false
+		}
+		p.client = rpc.NewClient(conn)
+	}
+	if err := p.client.Call(method, args, reply); err != nil {
+		p.client.Close()
+		p.client = nil
+		return false
+	}
+	return true
+}
+
+func (p *rpcPaxosPeer) callPrepare(args PrepareArgs) (PrepareReply, bool) {
+	var reply PrepareReply
+	ok := p.call("MDServerPaxosRPC.Prepare", args, &reply)
+	return reply, ok
+}
+
+func (p *rpcPaxosPeer) callAccept(args AcceptArgs) (AcceptReply, bool) {
+	var reply AcceptReply
+	ok := p.call("MDServerPaxosRPC.Accept", args, &reply)
+	return reply, ok
+}
+
+func (p *rpcPaxosPeer) callDecided(args DecidedArgs) {
+	var reply struct{}
+	p.call("MDServerPaxosRPC.Decided", args, &reply)
+}
+
+// MDServerPaxos is a MDServer that replicates every mutating operation
+// (PutMD, PruneBranch, TruncateLock) across a small cluster of peers
+// via Paxos before applying it to the underlying local store, so that
+// the local MDServer can survive the loss of a minority of peers. It
+// is intended for multi-node integration tests and small self-hosted
+// clusters, not as a replacement for MDServerRemote in production.
+type MDServerPaxos struct {
+	config Config
+	store  MDServer // the underlying local (or LevelDB) store
+	log    *paxosLog
+	me     int
+
+	mu        sync.Mutex
+	nextSeq   paxosSeq
+	nextNonce uint64
+	pending   map[paxosSeq]interface{} // decided ops not yet applied, by seq
+	applied   paxosSeq                 // highest seq applied to store so far
+
+	rpcServer *rpc.Server
+	listener  net.Listener
+}
+
+// NewMDServerPaxos returns a MDServerPaxos for peer index me out of
+// peers, which are the paths to every peer's unix socket; it listens on
+// the one at peers[me]. Mutating
+// ops are applied, in sequence order, to db (a MDServerLevelDB), if db is
+// non-nil, or otherwise to a MDServerLocal rooted at rootDir.
+func NewMDServerPaxos(config Config, db kv.DB, peers []string, me int, rootDir string) (
+	*MDServerPaxos, error) {
+	if me < 0 || me >= len(peers) {
+		return nil, fmt.Errorf("peer index %d out of range for %d peers", me, len(peers))
+	}
+
+	var store MDServer
+	if db != nil {
+		var err error
+		store, err = NewMDServerLevelDB(config, db)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		handlePath := filepath.Join(rootDir, "kbfs_handles")
+		mdPath := filepath.Join(rootDir, "kbfs_md")
+		revPath := filepath.Join(rootDir, "kbfs_revisions")
+		var err error
+		store, err = NewMDServerLocal(config, handlePath, mdPath, revPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	paxosPeers := make([]paxosPeer, len(peers))
+	for i, sockPath := range peers {
+		paxosPeers[i] = &rpcPaxosPeer{sockPath: sockPath}
+	}
+
+	mds := &MDServerPaxos{
+		config:  config,
+		store:   store,
+		log:     newPaxosLog(me, paxosPeers),
+		me:      me,
+		nextSeq: 1,
+		pending: make(map[paxosSeq]interface{}),
+	}
+
+	if err := mds.listen(peers[me]); err != nil {
+		return nil, err
+	}
+	return mds, nil
+}
+
+func (md *MDServerPaxos) listen(sockPath string) error {
+	os.Remove(sockPath)
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		return err
+	}
+	md.listener = l
+
+	md.rpcServer = rpc.NewServer()
+	if err := md.rpcServer.RegisterName("MDServerPaxosRPC", &MDServerPaxosRPC{server: md}); err != nil {
+		return err
+	}
+	go md.rpcServer.Accept(l)
+	return nil
+}
+
+// propose runs op through the Paxos log and, once it (or a
+// conflicting op that won the same instance) is decided, applies
+// whatever was decided to the local store, returning an error if this
+// peer's own op lost the race, or if it won the race but the local
+// store failed to persist it.
+func (md *MDServerPaxos) propose(op mdPaxosOp) error {
+	md.mu.Lock()
+	seq := md.nextSeq
+	md.nextSeq++
+	md.nextNonce++
+	op.Nonce = mdPaxosNonce{Peer: md.me, Counter: md.nextNonce}
+	md.mu.Unlock()
+
+	decided, ok := md.log.propose(seq, op)
+	if !ok {
+		return fmt.Errorf("paxos: could not reach a majority of peers for seq %d", seq)
+	}
+
+	applyErr := md.applyDecidedLocked(seq, decided)
+
+	decidedOp, ok := decided.(mdPaxosOp)
+	if !ok || decidedOp.Nonce != op.Nonce {
+		return fmt.Errorf("paxos: lost the race for seq %d to a concurrent op", seq)
+	}
+	if applyErr != nil {
+		return fmt.Errorf("paxos: won the race for seq %d but failed to apply it locally: %v", seq, applyErr)
+	}
+	return nil
+}
+
+// applyDecidedLocked applies a decided op to the local store, but only
+// once every earlier-numbered instance has already been applied;
+// out-of-order decisions are buffered in md.pending until their
+// predecessors arrive. It returns the error (if any) from applying the
+// op at seq specifically, so propose can report it to its own caller;
+// errors from any other op applied along the way (unblocked by this
+// one arriving) are only logged, since there's no caller left waiting
+// on them.
+func (md *MDServerPaxos) applyDecidedLocked(seq paxosSeq, value interface{}) error {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+
+	if seq <= md.applied {
+		return nil
+	}
+	md.pending[seq] = value
+
+	var seqErr error
+	for {
+		next := md.applied + 1
+		op, ok := md.pending[next]
+		if !ok {
+			break
+		}
+		delete(md.pending, next)
+		if err := md.applyOp(op.(mdPaxosOp)); err != nil {
+			libkb.G.Log.Warning("paxos: failed to apply decided op at seq %d: %v", next, err)
+			if next == seq {
+				seqErr = err
+			}
+		}
+		md.applied = next
+	}
+	return seqErr
+}
+
+func (md *MDServerPaxos) applyOp(op mdPaxosOp) error {
+	switch op.Kind {
+	case "put":
+		return md.store.PutMD(op.ID, op.RMD)
+	case "pruneBranch":
+		return md.store.PruneBranch(op.PBTlfID, op.BID)
+	case "truncateLock":
+		_, err := md.store.TruncateLock(op.LockTlfID, op.LockUser)
+		return err
+	}
+	return fmt.Errorf("paxos: unknown op kind %q", op.Kind)
+}
+
+// PutMD replicates rmd across the Paxos cluster before storing it, so
+// that a write only completes once a majority of peers agree on it.
+func (md *MDServerPaxos) PutMD(id TlfID, rmd *RootMetadataSigned) error {
+	return md.propose(mdPaxosOp{Kind: "put", ID: id, RMD: rmd})
+}
+
+// PruneBranch replicates the removal of every revision on bid for id
+// across the Paxos cluster before applying it to the local store.
+func (md *MDServerPaxos) PruneBranch(id TlfID, bid BranchID) error {
+	return md.propose(mdPaxosOp{Kind: "pruneBranch", PBTlfID: id, BID: bid})
+}
+
+// TruncateLock replicates a truncate-lock acquisition attempt for id on
+// behalf of uid across the Paxos cluster before applying it to the
+// local store.
+func (md *MDServerPaxos) TruncateLock(id TlfID, uid keybase1.UID) error {
+	return md.propose(mdPaxosOp{Kind: "truncateLock", LockTlfID: id, LockUser: uid})
+}
+
+// GetForTLF reads the most recent RootMetadataSigned for (id, bid)
+// directly from the local store; reads don't need to go through Paxos,
+// since every peer's store is kept in sync by the ops that do.
+func (md *MDServerPaxos) GetForTLF(id TlfID, bid BranchID) (*RootMetadataSigned, error) {
+	return md.store.GetForTLF(id, bid)
+}
+
+// GetRange reads every RootMetadataSigned for (id, bid) between start
+// and stop directly from the local store.
+func (md *MDServerPaxos) GetRange(id TlfID, bid BranchID, start, stop MetadataRevision) (
+	[]*RootMetadataSigned, error) {
+	return md.store.GetRange(id, bid, start, stop)
+}
+
+// Min returns the lowest Paxos sequence number that may still need to
+// be retained across all peers, mirroring the classic paxos library's
+// Min call. Instance state below Min can be safely discarded.
+func (md *MDServerPaxos) Min() paxosSeq {
+	return md.log.Min()
+}
+
+// Done tells the Paxos log that this peer no longer needs state for
+// instances <= seq, so that Min can advance once every peer agrees.
+func (md *MDServerPaxos) Done(seq paxosSeq) {
+	md.log.setDone(seq)
+}
+
+// Shutdown implements the MDServer interface for MDServerPaxos.
+func (md *MDServerPaxos) Shutdown() {
+	if md.listener != nil {
+		md.listener.Close()
+	}
+	md.store.Shutdown()
+}
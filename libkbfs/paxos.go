@@ -0,0 +1,308 @@
+package libkbfs
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// maxProposeAttempts bounds how many Prepare/Accept rounds propose will
+// retry before giving up on seq, so that a peer partitioned from the
+// majority eventually reports failure instead of spinning forever.
+const maxProposeAttempts = 10
+
+// proposeBackoff returns how long to sleep before retrying the
+// attempt'th (0-indexed) failed round for seq, doubling up to a cap and
+// adding jitter so that peers racing each other don't retry in lockstep.
+func proposeBackoff(attempt int) time.Duration {
+	const (
+		base = 10 * time.Millisecond
+		max  = 500 * time.Millisecond
+	)
+	backoff := base << uint(attempt)
+	if backoff <= 0 || backoff > max {
+		backoff = max
+	}
+	return backoff/2 + time.Duration(rand.Int63n(int64(backoff/2+1)))
+}
+
+// paxosSeq is the monotonically increasing sequence number that
+// identifies a single Paxos instance (i.e. a single decided value) in
+// the replicated MD log kept by MDServerPaxos.
+type paxosSeq uint64
+
+// proposalNumber orders competing proposals for the same paxosSeq.
+// Ties are broken by peer index, so that no two peers ever pick the
+// same number for the same instance.
+type proposalNumber struct {
+	round uint64
+	peer  int
+}
+
+func (n proposalNumber) less(o proposalNumber) bool {
+	if n.round != o.round {
+		return n.round < o.round
+	}
+	return n.peer < o.peer
+}
+
+func (n proposalNumber) zero() bool {
+	return n.round == 0 && n.peer == 0
+}
+
+// paxosInstance holds one peer's acceptor and proposer state for a
+// single paxosSeq, i.e. (n_p, n_a, v_a, decided) plus the highest
+// proposal number this peer has itself proposed.
+type paxosInstance struct {
+	// acceptor state
+	np proposalNumber // highest prepare promised
+	na proposalNumber // highest accept accepted
+	va interface{}    // value of na
+
+	decided  bool
+	value    interface{}
+	proposed proposalNumber // highest proposal this peer has sent
+}
+
+// PrepareArgs/PrepareReply and AcceptArgs/AcceptReply below mirror the
+// classic Paxos RPCs; DecidedArgs is a best-effort broadcast once a
+// majority has accepted a value, so peers can apply it without having
+// to run another round to learn the outcome.
+
+// PrepareArgs is the Prepare(n) request for instance Seq.
+type PrepareArgs struct {
+	Seq paxosSeq
+	N   proposalNumber
+}
+
+// PrepareReply is the Promise (or rejection) for a PrepareArgs.
+type PrepareReply struct {
+	OK bool
+	Na proposalNumber
+	Va interface{}
+}
+
+// AcceptArgs is the Accept(n, v) request for instance Seq.
+type AcceptArgs struct {
+	Seq paxosSeq
+	N   proposalNumber
+	V   interface{}
+}
+
+// AcceptReply is the Accepted (or rejection) for an AcceptArgs.
+type AcceptReply struct {
+	OK bool
+}
+
+// DecidedArgs announces that instance Seq has decided on value V, and
+// also carries the sender's Done value so peers can advance their
+// low-water mark for garbage collection.
+type DecidedArgs struct {
+	Seq  paxosSeq
+	V    interface{}
+	Me   int
+	Done paxosSeq
+}
+
+// paxosPeer is the interface paxosLog uses to talk to one peer,
+// implemented over net/rpc by rpcPaxosPeer.
+type paxosPeer interface {
+	callPrepare(args PrepareArgs) (PrepareReply, bool)
+	callAccept(args AcceptArgs) (AcceptReply, bool)
+	callDecided(args DecidedArgs)
+}
+
+// paxosLog runs an independent Paxos instance per paxosSeq over a set
+// of peers, in the style of the classic single-decree Paxos libraries:
+// a proposer picks n = max(seen)+1 tagged with its own peer index, and
+// drives Prepare -> Promise, then Accept -> Accepted, then broadcasts
+// Decided.
+type paxosLog struct {
+	mu    sync.Mutex
+	me    int
+	peers []paxosPeer
+
+	instances map[paxosSeq]*paxosInstance
+	done      []paxosSeq // highest Done value seen from each peer
+	min       paxosSeq   // lowest instance any peer might still need
+}
+
+func newPaxosLog(me int, peers []paxosPeer) *paxosLog {
+	done := make([]paxosSeq, len(peers))
+	return &paxosLog{
+		me:        me,
+		peers:     peers,
+		instances: make(map[paxosSeq]*paxosInstance),
+		done:      done,
+	}
+}
+
+func (l *paxosLog) instance(seq paxosSeq) *paxosInstance {
+	inst, ok := l.instances[seq]
+	if !ok {
+		inst = &paxosInstance{}
+		l.instances[seq] = inst
+	}
+	return inst
+}
+
+func (l *paxosLog) majority() int {
+	return len(l.peers)/2 + 1
+}
+
+// propose drives a full Prepare/Accept/Decided round for seq, proposing
+// v if no other value is already being proposed by a majority. It
+// blocks until a value is decided (which may not be v) or returns
+// false if this peer can no longer make progress (e.g. it lost contact
+// with a majority of peers for maxProposeAttempts rounds in a row),
+// backing off with jitter between failed rounds so a partitioned peer
+// doesn't spin re-sending Prepare/Accept to every peer at full speed.
+func (l *paxosLog) propose(seq paxosSeq, v interface{}) (interface{}, bool) {
+	for attempt := 0; attempt < maxProposeAttempts; attempt++ {
+		l.mu.Lock()
+		inst := l.instance(seq)
+		if inst.decided {
+			value := inst.value
+			l.mu.Unlock()
+			return value, true
+		}
+		round := inst.proposed.round
+		if inst.np.round > round {
+			round = inst.np.round
+		}
+		inst.proposed = proposalNumber{round: round + 1, peer: l.me}
+		n := inst.proposed
+		l.mu.Unlock()
+
+		promises := 0
+		var highest proposalNumber
+		value := v
+		for _, p := range l.peers {
+			reply, ok := p.callPrepare(PrepareArgs{Seq: seq, N: n})
+			if !ok || !reply.OK {
+				continue
+			}
+			promises++
+			if !reply.Na.zero() && highest.less(reply.Na) {
+				highest = reply.Na
+				value = reply.Va
+			}
+		}
+		if promises < l.majority() {
+			time.Sleep(proposeBackoff(attempt))
+			continue
+		}
+
+		accepts := 0
+		for _, p := range l.peers {
+			reply, ok := p.callAccept(AcceptArgs{Seq: seq, N: n, V: value})
+			if ok && reply.OK {
+				accepts++
+			}
+		}
+		if accepts < l.majority() {
+			time.Sleep(proposeBackoff(attempt))
+			continue
+		}
+
+		l.mu.Lock()
+		inst.decided = true
+		inst.value = value
+		l.mu.Unlock()
+
+		for _, p := range l.peers {
+			p.callDecided(DecidedArgs{Seq: seq, V: value, Me: l.me, Done: l.done[l.me]})
+		}
+		return value, true
+	}
+	return nil, false
+}
+
+// handlePrepare implements the acceptor side of Prepare(n).
+func (l *paxosLog) handlePrepare(args PrepareArgs) PrepareReply {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inst := l.instance(args.Seq)
+	if !inst.np.zero() && !inst.np.less(args.N) {
+		return PrepareReply{OK: false}
+	}
+	inst.np = args.N
+	return PrepareReply{OK: true, Na: inst.na, Va: inst.va}
+}
+
+// handleAccept implements the acceptor side of Accept(n, v).
+func (l *paxosLog) handleAccept(args AcceptArgs) AcceptReply {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inst := l.instance(args.Seq)
+	if !inst.np.zero() && args.N.less(inst.np) {
+		return AcceptReply{OK: false}
+	}
+	inst.np = args.N
+	inst.na = args.N
+	inst.va = args.V
+	return AcceptReply{OK: true}
+}
+
+// handleDecided records a peer's Decided broadcast and advances the
+// low-water mark used by Min.
+func (l *paxosLog) handleDecided(args DecidedArgs) interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inst := l.instance(args.Seq)
+	inst.decided = true
+	inst.value = args.V
+	if args.Me < len(l.done) && args.Done > l.done[args.Me] {
+		l.done[args.Me] = args.Done
+	}
+	l.recomputeMinLocked()
+	return args.V
+}
+
+// setDone marks that this peer no longer needs instances <= seq, for GC
+// purposes, mirroring the classic paxos library's Done call.
+func (l *paxosLog) setDone(seq paxosSeq) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if seq > l.done[l.me] {
+		l.done[l.me] = seq
+	}
+	l.recomputeMinLocked()
+}
+
+func (l *paxosLog) recomputeMinLocked() {
+	min := l.done[0]
+	for _, d := range l.done[1:] {
+		if d < min {
+			min = d
+		}
+	}
+	l.min = min + 1
+	for seq := range l.instances {
+		if seq < l.min {
+			delete(l.instances, seq)
+		}
+	}
+}
+
+// Min returns the lowest paxosSeq for which state may still need to be
+// retained, i.e. one past the lowest Done value seen from all peers.
+// It is 0 until this peer has recorded a Done value or a Decided
+// broadcast.
+func (l *paxosLog) Min() paxosSeq {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.min
+}
+
+// status returns whether seq has decided, and if so its value, without
+// blocking or starting a new proposal.
+func (l *paxosLog) status(seq paxosSeq) (decided bool, value interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	inst, ok := l.instances[seq]
+	if !ok || !inst.decided {
+		return false, nil
+	}
+	return true, inst.value
+}
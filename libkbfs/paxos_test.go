@@ -0,0 +1,163 @@
+package libkbfs
+
+import (
+	"sync"
+	"testing"
+)
+
+// localPaxosPeer implements paxosPeer by calling straight into another
+// paxosLog in the same process, so tests can exercise a multi-peer
+// Paxos round without going over the network.
+type localPaxosPeer struct {
+	log *paxosLog
+}
+
+func (p *localPaxosPeer) callPrepare(args PrepareArgs) (PrepareReply, bool) {
+	return p.log.handlePrepare(args), true
+}
+
+func (p *localPaxosPeer) callAccept(args AcceptArgs) (AcceptReply, bool) {
+	return p.log.handleAccept(args), true
+}
+
+func (p *localPaxosPeer) callDecided(args DecidedArgs) {
+	p.log.handleDecided(args)
+}
+
+// newLocalPaxosCluster returns n paxosLogs, each wired up to talk to
+// every other one (including itself) via localPaxosPeer, mirroring how
+// NewMDServerPaxos wires up peers (including peers[me]) over RPC.
+func newLocalPaxosCluster(n int) []*paxosLog {
+	logs := make([]*paxosLog, n)
+	for i := range logs {
+		// newPaxosLog sizes l.done from len(peers), so pass a
+		// correctly-sized placeholder; the real peers (which need all
+		// the logs to exist first) are wired up below.
+		logs[i] = newPaxosLog(i, make([]paxosPeer, n))
+	}
+	for _, l := range logs {
+		peers := make([]paxosPeer, n)
+		for j, other := range logs {
+			peers[j] = &localPaxosPeer{log: other}
+		}
+		l.peers = peers
+	}
+	return logs
+}
+
+func TestPaxosLogProposeDecides(t *testing.T) {
+	logs := newLocalPaxosCluster(3)
+
+	value, ok := logs[0].propose(1, "hello")
+	if !ok {
+		t.Fatal("propose did not reach a majority")
+	}
+	if value != "hello" {
+		t.Fatalf("got decided value %v, want %q", value, "hello")
+	}
+
+	decided, v := logs[0].status(1)
+	if !decided || v != "hello" {
+		t.Fatalf("status = (%v, %v), want (true, %q)", decided, v, "hello")
+	}
+}
+
+func TestPaxosLogConcurrentProposalsConverge(t *testing.T) {
+	// This mirrors the scenario that broke MDServerPaxos.propose's old
+	// Kind/ID comparison: two peers race to decide the same seq with
+	// different values (e.g. two different PruneBranch ops that happen
+	// to land on the same seq because each peer's nextSeq advances
+	// independently). Exactly one value should be decided, and both
+	// proposing peers -- including the one whose own value lost -- must
+	// agree on what it was.
+	logs := newLocalPaxosCluster(3)
+
+	var wg sync.WaitGroup
+	results := make([]interface{}, 2)
+	oks := make([]bool, 2)
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		results[0], oks[0] = logs[0].propose(1, "peer0-value")
+	}()
+	go func() {
+		defer wg.Done()
+		results[1], oks[1] = logs[1].propose(1, "peer1-value")
+	}()
+	wg.Wait()
+
+	if !oks[0] || !oks[1] {
+		t.Fatalf("propose did not reach a majority: oks = %v", oks)
+	}
+	if results[0] != results[1] {
+		t.Fatalf("peers disagree on the decided value: %v != %v", results[0], results[1])
+	}
+	if results[0] != "peer0-value" && results[0] != "peer1-value" {
+		t.Fatalf("decided value %v was neither proposal", results[0])
+	}
+}
+
+func TestPaxosLogHandlePrepareRejectsOlderProposal(t *testing.T) {
+	l := newPaxosLog(0, nil)
+
+	reply := l.handlePrepare(PrepareArgs{Seq: 1, N: proposalNumber{round: 2, peer: 0}})
+	if !reply.OK {
+		t.Fatal("expected first Prepare to be promised")
+	}
+
+	reply = l.handlePrepare(PrepareArgs{Seq: 1, N: proposalNumber{round: 1, peer: 1}})
+	if reply.OK {
+		t.Fatal("expected Prepare with a lower proposal number to be rejected")
+	}
+}
+
+func TestPaxosLogPrepareReturnsHighestAcceptedValue(t *testing.T) {
+	l := newPaxosLog(0, nil)
+
+	n1 := proposalNumber{round: 1, peer: 0}
+	if reply := l.handleAccept(AcceptArgs{Seq: 1, N: n1, V: "v1"}); !reply.OK {
+		t.Fatal("expected first Accept to succeed")
+	}
+
+	n2 := proposalNumber{round: 2, peer: 0}
+	reply := l.handlePrepare(PrepareArgs{Seq: 1, N: n2})
+	if !reply.OK || reply.Na != n1 || reply.Va != "v1" {
+		t.Fatalf("Prepare reply = %+v, want Na=%v Va=%q", reply, n1, "v1")
+	}
+
+	// An Accept carrying an older proposal number than what's already
+	// been promised must be rejected.
+	if reply := l.handleAccept(AcceptArgs{Seq: 1, N: n1, V: "stale"}); reply.OK {
+		t.Fatal("expected Accept with a stale proposal number to be rejected")
+	}
+}
+
+func TestPaxosLogMinAdvancesWithDone(t *testing.T) {
+	logs := newLocalPaxosCluster(3)
+
+	for i, l := range logs {
+		if min := l.Min(); min != 0 {
+			t.Fatalf("peer %d initial Min() = %d, want 0", i, min)
+		}
+	}
+
+	// Each peer first learns, locally, that it no longer needs
+	// instances <= 1 ...
+	for _, l := range logs {
+		l.setDone(1)
+	}
+	// ... but that only takes effect cluster-wide once it's propagated
+	// via a Decided broadcast, so every peer proposes once more to
+	// announce its new Done value to the rest of the cluster.
+	for i, l := range logs {
+		if _, ok := l.propose(paxosSeq(10+i), "v"); !ok {
+			t.Fatalf("peer %d: propose did not reach a majority", i)
+		}
+	}
+
+	for i, l := range logs {
+		if min := l.Min(); min != 2 {
+			t.Fatalf("peer %d Min() after every peer's Done propagated = %d, want 2", i, min)
+		}
+	}
+}